@@ -0,0 +1,45 @@
+package data
+
+import (
+	"fmt"
+	"time"
+)
+
+// ScanImageInfo is the payload Aqua sends to the webhook server for a single
+// image scan result.
+type ScanImageInfo struct {
+	Registry               string
+	Image                  string
+	ApplicationScopeOwners []string
+	Disallowed             bool
+
+	Negligible int
+	Low        int
+	Medium     int
+	High       int
+	Critical   int
+
+	Resources []Resource
+}
+
+// Resource is a single scanned artifact (package, file, etc.) inside an image.
+type Resource struct {
+	Name            string
+	Version         string
+	Vulnerabilities []Vulnerability
+}
+
+// Vulnerability describes a single CVE found in a Resource.
+type Vulnerability struct {
+	Name          string
+	Severity      string
+	FixVersion    string
+	CVSS          float64
+	PublishedDate time.Time
+}
+
+// GetUniqueId returns the identifier used to correlate a scan with its
+// previous run in dbservice.
+func (s *ScanImageInfo) GetUniqueId() string {
+	return fmt.Sprintf("%s/%s", s.Registry, s.Image)
+}
@@ -0,0 +1,153 @@
+package dbservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"data"
+)
+
+// HandleCurrentInfo reports whether scanInfo is a new result along with the
+// raw bytes of the previous scan. It keeps no scan history: nothing is
+// stored, every scan is reported as new, and no previous scan is returned.
+func HandleCurrentInfo(scanInfo *data.ScanImageInfo) (prevScanSource []byte, isNew bool, err error) {
+	return nil, true, nil
+}
+
+// DropPolicy decides what happens to a plugin's pending scans when its queue
+// grows past QueueOptions.MaxSize.
+type DropPolicy string
+
+const (
+	// DropOldest discards the longest-waiting entries to make room, the
+	// default when a MaxSize is set without an explicit policy.
+	DropOldest DropPolicy = "drop-oldest"
+	// DropNewest discards the entries that would have been added last.
+	DropNewest DropPolicy = "drop-newest"
+	// SpillToDisk writes overflow entries to SpillDir instead of discarding
+	// them, so they aren't lost outright.
+	SpillToDisk DropPolicy = "spill-to-disk"
+)
+
+// QueueOptions bounds how large a single plugin's pending aggregation queue
+// is allowed to grow between flushes.
+type QueueOptions struct {
+	MaxSize  int
+	Policy   DropPolicy
+	SpillDir string
+}
+
+var (
+	queuesMu sync.Mutex
+	queues   = map[string][]map[string]string{}
+)
+
+// AggregateScans adds currentContent to the pending queue for pluginName and
+// returns the queue once it reaches counts entries. When ignoreLength is set
+// it only queues currentContent and returns nil, leaving the queue for a
+// later call to drain. It is equivalent to AggregateScansBounded with a
+// zero QueueOptions, i.e. an unbounded queue.
+func AggregateScans(pluginName string, currentContent map[string]string, counts int, ignoreLength bool) ([]map[string]string, error) {
+	queue, _, err := AggregateScansBounded(pluginName, currentContent, counts, ignoreLength, QueueOptions{})
+	return queue, err
+}
+
+// AggregateScansBounded behaves like AggregateScans, but additionally caps
+// the queue at opts.MaxSize (when positive), applying opts.Policy to
+// whatever doesn't fit and reporting how many entries that cost.
+func AggregateScansBounded(pluginName string, currentContent map[string]string, counts int, ignoreLength bool, opts QueueOptions) (queue []map[string]string, dropped int, err error) {
+	queuesMu.Lock()
+	defer queuesMu.Unlock()
+
+	if len(currentContent) > 0 {
+		grown := append(queues[pluginName], currentContent)
+		var capped []map[string]string
+		capped, dropped = enforceQueueCap(pluginName, grown, opts)
+		queues[pluginName] = capped
+	}
+
+	queue = queues[pluginName]
+	if len(queue) == 0 {
+		return nil, dropped, nil
+	}
+	if ignoreLength || (counts > 0 && len(queue) < counts) {
+		return nil, dropped, nil
+	}
+
+	delete(queues, pluginName)
+	return queue, dropped, nil
+}
+
+func enforceQueueCap(pluginName string, queue []map[string]string, opts QueueOptions) ([]map[string]string, int) {
+	if opts.MaxSize <= 0 || len(queue) <= opts.MaxSize {
+		return queue, 0
+	}
+
+	overflow := len(queue) - opts.MaxSize
+	switch opts.Policy {
+	case DropNewest:
+		return queue[:opts.MaxSize], overflow
+	case SpillToDisk:
+		spillToDisk(pluginName, queue[:overflow], opts.SpillDir)
+		return queue[overflow:], 0
+	default: // DropOldest, and the unset default.
+		return queue[overflow:], overflow
+	}
+}
+
+func spillToDisk(pluginName string, dropped []map[string]string, dir string) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	enc, err := json.Marshal(dropped)
+	if err != nil {
+		return
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%s-overflow-%d.json", pluginName, time.Now().UnixNano()))
+	_ = os.WriteFile(path, enc, 0644)
+}
+
+type sentRecord struct {
+	hash      string
+	expiresAt time.Time
+}
+
+var (
+	sentMu      sync.Mutex
+	sentRecords = map[string]sentRecord{}
+)
+
+// RememberSent checks whether (plugin, key) was already sent with the same
+// hash within ttl of now. If so, it returns true and leaves the existing
+// record untouched, so the caller can suppress the duplicate. Otherwise it
+// records (hash, now+ttl) for next time and returns false.
+func RememberSent(plugin, key, hash string, ttl time.Duration) (alreadySent bool, err error) {
+	sentMu.Lock()
+	defer sentMu.Unlock()
+
+	k := plugin + "|" + key
+	now := time.Now()
+	sweepExpiredSentRecords(now)
+	if rec, ok := sentRecords[k]; ok && now.Before(rec.expiresAt) && rec.hash == hash {
+		return true, nil
+	}
+
+	sentRecords[k] = sentRecord{hash: hash, expiresAt: now.Add(ttl)}
+	return false, nil
+}
+
+// sweepExpiredSentRecords drops every sentRecord whose suppression window
+// has already passed, so sentRecords doesn't grow without bound for a
+// server that scans many distinct (plugin, image) pairs over its lifetime.
+// Callers must hold sentMu.
+func sweepExpiredSentRecords(now time.Time) {
+	for k, rec := range sentRecords {
+		if !now.Before(rec.expiresAt) {
+			delete(sentRecords, k)
+		}
+	}
+}
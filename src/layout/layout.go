@@ -0,0 +1,19 @@
+package layout
+
+import "data"
+
+// LayoutProvider renders the human-facing description attached to a ticket
+// or notification for a given plugin type (Jira, Slack, email, ...).
+type LayoutProvider interface {
+	Name() string
+}
+
+// GenTicketDescription returns the body text for a scan notification. It
+// returns url as the whole description: no scan details are rendered and
+// prevScan is not diffed against.
+func GenTicketDescription(provider LayoutProvider, scanInfo, prevScan *data.ScanImageInfo, url string) string {
+	if provider == nil {
+		return url
+	}
+	return url
+}
@@ -0,0 +1,14 @@
+package plugins
+
+import (
+	"layout"
+	"settings"
+)
+
+// Plugin is the interface every notification target (Jira, Slack, email,
+// webhook, ...) implements.
+type Plugin interface {
+	GetSettings() *settings.Settings
+	GetLayoutProvider() layout.LayoutProvider
+	Send(content map[string]string) error
+}
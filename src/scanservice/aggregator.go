@@ -0,0 +1,319 @@
+package scanservice
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"plugins"
+	"scanservice/events"
+)
+
+// defaultAggregator is the single scheduler used for every plugin's
+// AggregateTimeoutSeconds flush.
+var defaultAggregator = newAggregator()
+
+// aggregatorMetrics are the counters exposed by MetricsHandler.
+type aggregatorMetrics struct {
+	queued  uint64
+	sent    uint64
+	dropped uint64
+	retried uint64
+}
+
+type pluginSchedule struct {
+	name    string
+	plugin  plugins.Plugin
+	period  time.Duration
+	next    time.Time
+	backoff time.Duration
+	// pending is a batch whose Send failed; it is retried before the queue
+	// is read again.
+	pending map[string]string
+}
+
+// pluginHeap orders pluginSchedules by next fire time, earliest first.
+type pluginHeap []*pluginSchedule
+
+func (h pluginHeap) Len() int           { return len(h) }
+func (h pluginHeap) Less(i, j int) bool  { return h[i].next.Before(h[j].next) }
+func (h pluginHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *pluginHeap) Push(x interface{}) { *h = append(*h, x.(*pluginSchedule)) }
+func (h *pluginHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// aggregator replaces the old one-goroutine-per-plugin scheduler: a min-heap
+// keyed by next-fire time lets one goroutine service every plugin, survive a
+// plugin whose Send blocks or panics (it just retries with backoff), and
+// flush whatever is still queued on shutdown.
+type aggregator struct {
+	mu      sync.Mutex
+	entries map[string]*pluginSchedule
+	order   pluginHeap
+	wake    chan struct{}
+	metrics aggregatorMetrics
+
+	running bool
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func newAggregator() *aggregator {
+	return &aggregator{
+		entries: map[string]*pluginSchedule{},
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Schedule registers plugin to be flushed every period (plus jitter), if it
+// isn't already scheduled, and starts the scheduler goroutine on first use.
+func (a *aggregator) Schedule(name string, plugin plugins.Plugin, period time.Duration) {
+	a.mu.Lock()
+	if _, ok := a.entries[name]; ok {
+		a.mu.Unlock()
+		return
+	}
+	ps := &pluginSchedule{name: name, plugin: plugin, period: period, next: time.Now().Add(jitter(period))}
+	a.entries[name] = ps
+	heap.Push(&a.order, ps)
+	a.wakeLocked()
+	needStart := !a.running
+	a.mu.Unlock()
+
+	if needStart {
+		a.start()
+	}
+}
+
+func (a *aggregator) start() {
+	a.mu.Lock()
+	if a.running {
+		a.mu.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	a.cancel = cancel
+	a.done = make(chan struct{})
+	a.running = true
+	a.mu.Unlock()
+
+	go a.run(ctx)
+}
+
+// Shutdown cancels the scheduler and blocks until it has flushed every
+// plugin's pending queue, or ctx is done first.
+func (a *aggregator) Shutdown(ctx context.Context) error {
+	a.mu.Lock()
+	if !a.running {
+		a.mu.Unlock()
+		return nil
+	}
+	cancel, done := a.cancel, a.done
+	a.mu.Unlock()
+
+	cancel()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (a *aggregator) wakeLocked() {
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (a *aggregator) run(ctx context.Context) {
+	defer close(a.done)
+	for {
+		wait := a.nextWait()
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			a.flushAll()
+			return
+		case <-timer.C:
+			a.fireDue()
+		case <-a.wake:
+			timer.Stop()
+		}
+	}
+}
+
+func (a *aggregator) nextWait() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.order.Len() == 0 {
+		return time.Hour
+	}
+	wait := time.Until(a.order[0].next)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+func (a *aggregator) fireDue() {
+	now := time.Now()
+	for {
+		a.mu.Lock()
+		if a.order.Len() == 0 || a.order[0].next.After(now) {
+			a.mu.Unlock()
+			return
+		}
+		ps := heap.Pop(&a.order).(*pluginSchedule)
+		a.mu.Unlock()
+
+		a.flushOne(ps)
+
+		delay := ps.period
+		if ps.backoff > 0 {
+			delay = ps.backoff
+		}
+		a.mu.Lock()
+		ps.next = time.Now().Add(jitter(delay))
+		heap.Push(&a.order, ps)
+		a.mu.Unlock()
+	}
+}
+
+func (a *aggregator) flushAll() {
+	a.mu.Lock()
+	entries := make([]*pluginSchedule, len(a.order))
+	copy(entries, a.order)
+	a.mu.Unlock()
+
+	for _, ps := range entries {
+		a.flushOne(ps)
+	}
+}
+
+func (a *aggregator) flushOne(ps *pluginSchedule) {
+	content := ps.pending
+	if content == nil {
+		queue := AggregateScanAndGetQueue(ps.name, nil, 0, false, nil)
+		if len(queue) == 0 {
+			return
+		}
+		content = buildAggregatedContent(queue, ps.plugin.GetLayoutProvider())
+	}
+	if err := sendWithTimeout(ps.plugin, content, sendTimeout); err != nil {
+		ps.pending = content
+		ps.backoff = nextBackoff(ps.backoff)
+		atomic.AddUint64(&a.metrics.retried, 1)
+		currentLogger().With("plugin", ps.name).Warn("aggregator: plugin Send failed, will retry",
+			"error", err, "backoff", ps.backoff)
+		return
+	}
+
+	ps.pending = nil
+	ps.backoff = 0
+	atomic.AddUint64(&a.metrics.sent, 1)
+	Events.Publish(events.ScanSent{Plugin: ps.name, Aggregated: true})
+}
+
+// sendTimeout bounds how long a single plugin's Send is allowed to run
+// before it's treated as failed, so one hung plugin can't stall the shared
+// scheduler goroutine and starve every other plugin's flush.
+const sendTimeout = 30 * time.Second
+
+// sendWithTimeout runs plugin.Send(content) on its own goroutine, so a
+// panicking Send can't crash the scheduler goroutine and a blocking Send
+// can't stall it past timeout. It returns once Send completes, panics, or
+// timeout elapses, whichever comes first; a timed-out Send is left running
+// in the background.
+func sendWithTimeout(plugin plugins.Plugin, content map[string]string, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("panic: %v", r)
+			}
+		}()
+		done <- plugin.Send(content)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("Send timed out after %s", timeout)
+	}
+}
+
+// nextBackoff doubles the previous backoff, starting at one second and
+// capping at ten minutes, so a plugin whose endpoint is down doesn't get
+// hammered at its normal aggregation period.
+func nextBackoff(prev time.Duration) time.Duration {
+	const (
+		initial = time.Second
+		max     = 10 * time.Minute
+	)
+	if prev <= 0 {
+		return initial
+	}
+	next := prev * 2
+	if next > max {
+		return max
+	}
+	return next
+}
+
+// jitter spreads a period out by +/-10% so every plugin sharing the same
+// AggregateTimeoutSeconds doesn't fire in lockstep.
+func jitter(period time.Duration) time.Duration {
+	if period <= 0 {
+		return 0
+	}
+	spread := period / 10
+	if spread <= 0 {
+		return period
+	}
+	return period - spread + time.Duration(rand.Int63n(int64(2*spread)))
+}
+
+// MetricsHandler serves the aggregator's queued/sent/dropped/retried
+// counters as JSON, so operators can scrape how the aggregation subsystem is
+// behaving in production.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]uint64{
+			"queued":  atomic.LoadUint64(&defaultAggregator.metrics.queued),
+			"sent":    atomic.LoadUint64(&defaultAggregator.metrics.sent),
+			"dropped": atomic.LoadUint64(&defaultAggregator.metrics.dropped),
+			"retried": atomic.LoadUint64(&defaultAggregator.metrics.retried),
+		})
+	})
+}
+
+// ShutdownAggregator flushes every plugin's pending aggregation queue and
+// stops the scheduler. Callers should invoke it during graceful shutdown,
+// before the process exits.
+func ShutdownAggregator(ctx context.Context) error {
+	return defaultAggregator.Shutdown(ctx)
+}
+
+func recordQueued() {
+	atomic.AddUint64(&defaultAggregator.metrics.queued, 1)
+}
+
+func recordDropped(n int) {
+	atomic.AddUint64(&defaultAggregator.metrics.dropped, uint64(n))
+}
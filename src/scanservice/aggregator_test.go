@@ -0,0 +1,168 @@
+package scanservice
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"dbservice"
+	"layout"
+	"settings"
+)
+
+type fakePlugin struct {
+	mu        sync.Mutex
+	sent      []map[string]string
+	failNextN int
+}
+
+func (p *fakePlugin) GetSettings() *settings.Settings          { return settings.GetDefaultSettings() }
+func (p *fakePlugin) GetLayoutProvider() layout.LayoutProvider { return nil }
+func (p *fakePlugin) Send(content map[string]string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failNextN > 0 {
+		p.failNextN--
+		return errSendFailed
+	}
+	p.sent = append(p.sent, content)
+	return nil
+}
+
+func (p *fakePlugin) sentCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.sent)
+}
+
+var errSendFailed = &sendError{}
+
+type sendError struct{}
+
+func (*sendError) Error() string { return "send failed" }
+
+// panickingPlugin always panics from Send, to exercise sendWithTimeout's
+// recover().
+type panickingPlugin struct{}
+
+func (panickingPlugin) GetSettings() *settings.Settings          { return settings.GetDefaultSettings() }
+func (panickingPlugin) GetLayoutProvider() layout.LayoutProvider { return nil }
+func (panickingPlugin) Send(map[string]string) error             { panic("boom") }
+
+// blockingPlugin never returns from Send until unblocked, to exercise
+// sendWithTimeout's timeout.
+type blockingPlugin struct {
+	unblock chan struct{}
+}
+
+func (blockingPlugin) GetSettings() *settings.Settings          { return settings.GetDefaultSettings() }
+func (blockingPlugin) GetLayoutProvider() layout.LayoutProvider { return nil }
+func (p blockingPlugin) Send(map[string]string) error {
+	<-p.unblock
+	return nil
+}
+
+func TestAggregatorFireDueFlushesQueuedEntries(t *testing.T) {
+	name := "test-fire-due-plugin"
+	dbservice.AggregateScans(name, map[string]string{"a": "1"}, 2, false)
+
+	plugin := &fakePlugin{}
+	a := newAggregator()
+	ps := &pluginSchedule{name: name, plugin: plugin, period: time.Hour, next: time.Now().Add(-time.Second)}
+	a.entries[name] = ps
+	a.order = append(a.order, ps)
+
+	a.fireDue()
+
+	if got := plugin.sentCount(); got != 1 {
+		t.Fatalf("expected plugin.Send to be called once, got %d", got)
+	}
+	if a.order.Len() != 1 {
+		t.Fatalf("expected the schedule to be rescheduled, got %d entries", a.order.Len())
+	}
+	if !a.order[0].next.After(time.Now()) {
+		t.Error("expected the rescheduled entry's next fire time to be in the future")
+	}
+}
+
+func TestAggregatorFireDueBacksOffOnSendFailure(t *testing.T) {
+	name := "test-backoff-plugin"
+	dbservice.AggregateScans(name, map[string]string{"a": "1"}, 2, false)
+
+	plugin := &fakePlugin{failNextN: 1}
+	a := newAggregator()
+	ps := &pluginSchedule{name: name, plugin: plugin, period: time.Hour, next: time.Now().Add(-time.Second)}
+	a.entries[name] = ps
+	a.order = append(a.order, ps)
+
+	a.fireDue()
+
+	if ps.backoff == 0 {
+		t.Error("expected backoff to be set after a failed Send")
+	}
+	if plugin.sentCount() != 0 {
+		t.Error("expected Send's content not to be recorded as sent after failure")
+	}
+}
+
+func TestAggregatorShutdownFlushesPendingQueues(t *testing.T) {
+	name := "test-shutdown-plugin"
+	dbservice.AggregateScans(name, map[string]string{"a": "1"}, 2, false)
+
+	plugin := &fakePlugin{}
+	a := newAggregator()
+	a.Schedule(name, plugin, time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := a.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	if got := plugin.sentCount(); got != 1 {
+		t.Fatalf("expected Shutdown to flush the pending queue, got %d sends", got)
+	}
+}
+
+func TestSendWithTimeoutRecoversFromPanic(t *testing.T) {
+	err := sendWithTimeout(panickingPlugin{}, nil, time.Second)
+	if err == nil {
+		t.Fatal("expected sendWithTimeout to return an error when Send panics")
+	}
+}
+
+func TestSendWithTimeoutBoundsABlockedSend(t *testing.T) {
+	unblock := make(chan struct{})
+	defer close(unblock)
+
+	err := sendWithTimeout(blockingPlugin{unblock: unblock}, nil, 20*time.Millisecond)
+	if err == nil {
+		t.Fatal("expected sendWithTimeout to return an error when Send blocks past the timeout")
+	}
+}
+
+func TestAggregatorFireDueBacksOffOnPanickingSend(t *testing.T) {
+	name := "test-panic-plugin"
+	dbservice.AggregateScans(name, map[string]string{"a": "1"}, 2, false)
+
+	a := newAggregator()
+	ps := &pluginSchedule{name: name, plugin: panickingPlugin{}, period: time.Hour, next: time.Now().Add(-time.Second)}
+	a.entries[name] = ps
+	a.order = append(a.order, ps)
+
+	a.fireDue()
+
+	if ps.backoff == 0 {
+		t.Error("expected backoff to be set after a panicking Send, and fireDue itself to survive it")
+	}
+}
+
+func TestAggregatorShutdownIsIdempotentWhenNeverStarted(t *testing.T) {
+	a := newAggregator()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := a.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown on a never-started aggregator should be a no-op, got: %v", err)
+	}
+}
@@ -0,0 +1,25 @@
+package scanservice
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+)
+
+// vulnerabilityDigest hashes the scan's vulnerability set (CVE name, fix
+// version, and the resource it was found in) so two scans of the same image
+// can be compared for "did anything actually change" regardless of
+// unrelated fields like timestamps.
+func (scan *ScanService) vulnerabilityDigest() string {
+	entries := make([]string, 0)
+	for _, r := range scan.scanInfo.Resources {
+		for _, v := range r.Vulnerabilities {
+			entries = append(entries, strings.Join([]string{r.Name, r.Version, v.Name, v.FixVersion}, "|"))
+		}
+	}
+	sort.Strings(entries)
+
+	h := sha256.Sum256([]byte(strings.Join(entries, ",")))
+	return hex.EncodeToString(h[:])
+}
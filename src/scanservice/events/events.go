@@ -0,0 +1,126 @@
+// Package events is a small typed pub/sub bus that ScanService publishes to
+// as it works through a scan result, so external subscribers (dashboards,
+// audit logs, swarm-style controllers) can observe what happened to each
+// Aqua scan without scraping log output.
+package events
+
+import (
+	"context"
+	"sync"
+)
+
+// Event is implemented by every event ScanService can publish.
+type Event interface {
+	// Name identifies the event type, e.g. for JSON sinks that want a
+	// discriminator field.
+	Name() string
+}
+
+// ScanReceived is published once per call to ScanService.ResultHandling
+// whose scan could be parsed, before any plugin policy is evaluated. A scan
+// that fails to parse publishes only ScanDropped.
+type ScanReceived struct {
+	ScanID   string
+	Registry string
+	Image    string
+}
+
+func (ScanReceived) Name() string { return "ScanReceived" }
+
+// ScanEvaluated is published once per plugin after its policies have been
+// checked against the scan.
+type ScanEvaluated struct {
+	ScanID  string
+	Plugin  string
+	Matched bool
+	Reasons []string
+}
+
+func (ScanEvaluated) Name() string { return "ScanEvaluated" }
+
+// ScanSent is published when content was actually handed to a plugin's
+// Send method, either for the current scan alone or as an aggregated batch.
+type ScanSent struct {
+	ScanID     string
+	Plugin     string
+	Aggregated bool
+}
+
+func (ScanSent) Name() string { return "ScanSent" }
+
+// ScanDropped is published when a scan couldn't be parsed in the first
+// place, or when a plugin whose policies matched the scan ends without
+// anything being sent, e.g. it was queued for aggregation or suppressed as a
+// duplicate. A plugin whose policies don't match publishes ScanEvaluated
+// with Matched false instead.
+type ScanDropped struct {
+	ScanID string
+	Plugin string
+	Reason string
+}
+
+func (ScanDropped) Name() string { return "ScanDropped" }
+
+// Bus fans a stream of Events out to any number of subscribers. The zero
+// value is not usable; create one with NewBus.
+type Bus struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+// NewBus returns an empty, ready-to-use Bus.
+func NewBus() *Bus {
+	return &Bus{subs: map[chan Event]struct{}{}}
+}
+
+// Subscribe returns a channel that receives every Event published after the
+// call, until ctx is done. The channel is buffered so a slow subscriber
+// doesn't block Publish; if it fills up, events are dropped for that
+// subscriber rather than backing up the scan pipeline.
+func (b *Bus) Subscribe(ctx context.Context) <-chan Event {
+	ch := make(chan Event, 64)
+
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		delete(b.subs, ch)
+		b.mu.Unlock()
+		close(ch)
+	}()
+
+	return ch
+}
+
+// Publish delivers e to every current subscriber. It never blocks on a slow
+// or full subscriber.
+func (b *Bus) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Sink consumes Events, typically to forward them somewhere outside the
+// process.
+type Sink interface {
+	Handle(Event)
+}
+
+// AddSink subscribes sink to b and forwards every event to it until ctx is
+// done. Sinks run on their own goroutine so a slow sink can't stall Publish.
+func (b *Bus) AddSink(ctx context.Context, sink Sink) {
+	ch := b.Subscribe(ctx)
+	go func() {
+		for e := range ch {
+			sink.Handle(e)
+		}
+	}()
+}
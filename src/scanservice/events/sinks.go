@@ -0,0 +1,92 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// record is the wire shape used by every sink: the event's Name alongside
+// its fields, so a JSON consumer can switch on "event" without knowing the
+// Go type.
+type record struct {
+	Event string      `json:"event"`
+	Data  interface{} `json:"data"`
+}
+
+func toRecord(e Event) record {
+	return record{Event: e.Name(), Data: e}
+}
+
+// StdoutSink writes every event to w (typically os.Stdout) as a line of
+// JSON.
+type StdoutSink struct {
+	w io.Writer
+}
+
+// NewStdoutSink returns a Sink that writes newline-delimited JSON to w.
+func NewStdoutSink(w io.Writer) *StdoutSink {
+	return &StdoutSink{w: w}
+}
+
+func (s *StdoutSink) Handle(e Event) {
+	enc, err := json.Marshal(toRecord(e))
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(s.w, string(enc))
+}
+
+// FileSink appends every event as a line of JSON to a file.
+type FileSink struct {
+	path string
+}
+
+// NewFileSink returns a Sink that appends newline-delimited JSON to the file
+// at path, creating it if necessary.
+func NewFileSink(path string) *FileSink {
+	return &FileSink{path: path}
+}
+
+func (s *FileSink) Handle(e Event) {
+	enc, err := json.Marshal(toRecord(e))
+	if err != nil {
+		return
+	}
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	f.Write(append(enc, '\n'))
+}
+
+// HTTPSink POSTs every event as a JSON body to url.
+type HTTPSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPSink returns a Sink that POSTs each event to url using client, or
+// http.DefaultClient if client is nil.
+func NewHTTPSink(url string, client *http.Client) *HTTPSink {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPSink{url: url, client: client}
+}
+
+func (s *HTTPSink) Handle(e Event) {
+	enc, err := json.Marshal(toRecord(e))
+	if err != nil {
+		return
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(enc))
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+}
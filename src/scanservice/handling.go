@@ -5,8 +5,9 @@ import (
 	"dbservice"
 	"fmt"
 	"layout"
-	"log"
+	"log/slog"
 	"plugins"
+	"scanservice/events"
 	"settings"
 	"strings"
 	"time"
@@ -18,12 +19,22 @@ type ScanService struct {
 	isNew    bool
 }
 
+// Events is the bus ScanService publishes ScanReceived/ScanEvaluated/
+// ScanSent/ScanDropped events to as it handles scans. Subscribe or attach a
+// sink to observe what the webhook server does with each Aqua scan.
+var Events = events.NewBus()
+
 func (scan *ScanService) ResultHandling(input string, plugins map[string]plugins.Plugin) {
+	log := currentLogger()
 	if err := scan.init(input); err != nil {
-		log.Println("ScanService.Init Error: Can't init service with data:", input, "\nError:", err)
+		log.Error("ScanService.init failed", "error", err)
+		Events.Publish(events.ScanDropped{Reason: "init: " + err.Error()})
 		return
 	}
-	log.Printf("Handling a scan result of '%s/%s'", scan.scanInfo.Registry, scan.scanInfo.Image)
+	scanID := scan.scanInfo.GetUniqueId()
+	log = log.With("scan_id", scanID, "registry", scan.scanInfo.Registry, "image", scan.scanInfo.Image)
+	Events.Publish(events.ScanReceived{ScanID: scanID, Registry: scan.scanInfo.Registry, Image: scan.scanInfo.Image})
+	log.Info("handling scan result")
 	owners := ""
 	if len(scan.scanInfo.ApplicationScopeOwners) > 0 {
 		owners = strings.Join(scan.scanInfo.ApplicationScopeOwners, ";")
@@ -33,63 +44,70 @@ func (scan *ScanService) ResultHandling(input string, plugins map[string]plugins
 		if plugin == nil {
 			continue
 		}
+		pluginLog := log.With("plugin", name)
 		currentSettings := plugin.GetSettings()
 		if currentSettings == nil {
 			currentSettings = settings.GetDefaultSettings()
 		}
 		if !scan.isNew && !currentSettings.PolicyShowAll {
-			log.Println("This scan's result is old:", scan.scanInfo.GetUniqueId())
+			skip(pluginLog, scanID, name, "scan is not new and PolicyShowAll is disabled")
 			continue
 		}
 
 		if len(currentSettings.PolicyMinVulnerability) > 0 && !scan.checkVulnerabilitiesLevel(currentSettings.PolicyMinVulnerability) {
-			log.Printf("ScanService: Scan %q contains only low-level vulnerabilities. Min level for %q is %q.\n",
-				scan.scanInfo.GetUniqueId(), name, currentSettings.PolicyMinVulnerability)
+			skip(pluginLog, scanID, name, "below PolicyMinVulnerability "+currentSettings.PolicyMinVulnerability)
+			continue
+		}
+
+		if !scan.checkCVSSPolicy(currentSettings) {
+			skip(pluginLog, scanID, name, "no vulnerability survives PolicyMinCVSS/PolicyIgnoreCVEs/PolicyRequireCVEs/PolicyMaxAgeDays")
 			continue
 		}
 
 		if len(currentSettings.IgnoreRegistry) > 0 && compliesPolicies(currentSettings.IgnoreRegistry, scan.scanInfo.Registry) {
-			log.Printf("ScanService: Registry %q was ignored by currentSettings for %q.\n", scan.scanInfo.Registry, name)
+			skip(pluginLog, scanID, name, "registry matches IgnoreRegistry")
 			continue
 		}
 
 		if len(currentSettings.IgnoreImageName) > 0 && compliesPolicies(currentSettings.IgnoreImageName, scan.scanInfo.Image) {
-			log.Printf("ScanService: Image %q was ignored by currentSettings for %q.\n", scan.scanInfo.Image, name)
+			skip(pluginLog, scanID, name, "image matches IgnoreImageName")
 			continue
 		}
 
 		if len(currentSettings.PolicyImageName) > 0 && !compliesPolicies(currentSettings.PolicyImageName, scan.scanInfo.Image) {
-			log.Printf("ScanService: Image %q wasn't allowed (missed) by currentSettings for %q.\n", scan.scanInfo.Image, name)
+			skip(pluginLog, scanID, name, "image doesn't match PolicyImageName")
 			continue
 		}
 
 		if len(currentSettings.PolicyRegistry) > 0 && !compliesPolicies(currentSettings.PolicyRegistry, scan.scanInfo.Registry) {
-			log.Printf("ScanService: Registry %q wasn't allowed by currentSettings for %q.\n", scan.scanInfo.Registry, name)
+			skip(pluginLog, scanID, name, "registry doesn't match PolicyRegistry")
 			continue
 		}
 
 		if currentSettings.PolicyNonCompliant && !scan.scanInfo.Disallowed {
-			log.Printf("This scan %q isn't Disallowed and will not sent by currentSettings for %q.\n", scan.scanInfo.GetUniqueId(), name)
+			skip(pluginLog, scanID, name, "scan is not Disallowed and PolicyNonCompliant is set")
 			continue
 		}
 
 		if currentSettings.PolicyOnlyFixAvailable && !scan.checkFixVersions() {
-			log.Printf("This scan %q doesn't contain vulnerabilities which have a fix version. Settings for %q.\n", scan.scanInfo.GetUniqueId(), name)
+			skip(pluginLog, scanID, name, "no vulnerability has a fix version and PolicyOnlyFixAvailable is set")
 			continue
 		}
 
 		if len(currentSettings.PolicyOPA) > 0 {
-			log.Printf("Plugin %q uses OPA policies from '%s'", currentSettings.PluginName, strings.Join(currentSettings.PolicyOPA, "','"))
-			if res, err := isRegoCorrect(currentSettings.PolicyOPA, input); err != nil {
-				log.Printf("isRegoCorrect error for %q OPA policy: %v", currentSettings.PluginName, err)
+			pluginLog.Debug("evaluating OPA policies", "policies", currentSettings.PolicyOPA)
+			if res, err := isRegoCorrect(currentSettings.PolicyOPA, currentSettings.PolicyOPAData, input); err != nil {
+				pluginLog.Error("isRegoCorrect failed", "error", err)
+				skip(pluginLog, scanID, name, "OPA evaluation error: "+err.Error())
 				continue
 			} else if !res {
-				log.Printf("Scan result for %q doesn't match OPA/REGO rules for %q",
-					scan.scanInfo.Image, currentSettings.PluginName)
+				skip(pluginLog, scanID, name, "OPA/REGO rules didn't match")
 				continue
 			}
 		}
 
+		Events.Publish(events.ScanEvaluated{ScanID: scanID, Plugin: name, Matched: true})
+
 		server := ""
 		if plSettings := plugin.GetSettings(); plSettings != nil {
 			server = plugin.GetSettings().AquaServer
@@ -102,55 +120,98 @@ func (scan *ScanService) ResultHandling(input string, plugins map[string]plugins
 
 		wasHandled := false
 		if currentSettings.AggregateIssuesNumber > 0 {
-			aggregated := AggregateScanAndGetQueue(name, content, currentSettings.AggregateIssuesNumber, false)
+			aggregated := AggregateScanAndGetQueue(name, content, currentSettings.AggregateIssuesNumber, false, currentSettings)
 			if len(aggregated) > 0 {
 				content = buildAggregatedContent(aggregated, plugin.GetLayoutProvider())
 			} else {
 				content = nil
+				Events.Publish(events.ScanDropped{ScanID: scanID, Plugin: name, Reason: "queued, waiting for AggregateIssuesNumber"})
+				handled(pluginLog, "queued", "waiting for AggregateIssuesNumber", false)
 			}
 			wasHandled = true
 		}
 
 		if currentSettings.AggregateTimeoutSeconds > 0 {
 			if !wasHandled {
-				AggregateScanAndGetQueue(name, content, 0, true)
+				AggregateScanAndGetQueue(name, content, 0, true, currentSettings)
 				content = nil
+				Events.Publish(events.ScanDropped{ScanID: scanID, Plugin: name, Reason: "queued, waiting for AggregateTimeoutSeconds"})
+				handled(pluginLog, "queued", "waiting for AggregateTimeoutSeconds", false)
 			}
-			if !currentSettings.IsScheduleRun {
-				plg := plugin
-				go func(nm string) {
-					log.Printf("Scheduler is actived for %q(%q). Period: %d sec",
-						nm, plg.GetSettings().PluginName, plg.GetSettings().AggregateTimeoutSeconds)
-					for {
-						time.Sleep(time.Duration(plg.GetSettings().AggregateTimeoutSeconds) * time.Second)
-						queue := AggregateScanAndGetQueue(nm, nil, 0, false)
-						if len(queue) > 0 {
-							send(plg, buildAggregatedContent(queue, plg.GetLayoutProvider()))
-						}
-					}
-				}(name)
-				currentSettings.IsScheduleRun = true
+			defaultAggregator.Schedule(name, plugin, time.Duration(currentSettings.AggregateTimeoutSeconds)*time.Second)
+		}
+
+		// Suppression is keyed off this single scan's own digest, so it only
+		// applies to the single-scan path: once wasHandled is true, content
+		// is an aggregated batch covering however many scans queued under
+		// name, and checking it against this scan's digest could drop
+		// other images' findings that happened to complete the batch.
+		if !wasHandled && len(content) > 0 && currentSettings.PolicySuppressDuplicatesSeconds > 0 {
+			ttl := time.Duration(currentSettings.PolicySuppressDuplicatesSeconds) * time.Second
+			digest := scan.vulnerabilityDigest()
+			if alreadySent, err := dbservice.RememberSent(name, scanID, digest, ttl); err != nil {
+				pluginLog.Error("RememberSent failed", "error", err)
+			} else if alreadySent {
+				reason := "duplicate alert suppressed within PolicySuppressDuplicatesSeconds"
+				Events.Publish(events.ScanDropped{ScanID: scanID, Plugin: name, Reason: reason})
+				handled(pluginLog, "skipped", reason, false)
+				content = nil
 			}
 		}
 
 		if len(content) > 0 {
-			send(plugin, content)
+			handled(pluginLog, "sent", "", wasHandled)
+			send(scanID, name, plugin, content, wasHandled)
 		}
 	}
 }
 
-func send(plg plugins.Plugin, cnt map[string]string) {
+// skip records a plugin passing on a scan: it publishes the ScanEvaluated
+// event, and logs the single terminal ScanHandled record for that plugin.
+func skip(l *slog.Logger, scanID, pluginName, reason string) {
+	Events.Publish(events.ScanEvaluated{ScanID: scanID, Plugin: pluginName, Matched: false, Reasons: []string{reason}})
+	l.Info("ScanHandled", "decision", "skipped", "reason", reason)
+}
+
+// handled logs the single terminal ScanHandled record for a plugin that
+// matched the scan's policies, summarizing what happened to it.
+func handled(l *slog.Logger, decision, reason string, aggregated bool) {
+	l.Info("ScanHandled", "decision", decision, "reason", reason, "aggregated", aggregated)
+}
+
+func send(scanID, pluginName string, plg plugins.Plugin, cnt map[string]string, aggregated bool) {
+	Events.Publish(events.ScanSent{ScanID: scanID, Plugin: pluginName, Aggregated: aggregated})
 	go plg.Send(cnt)
 }
 
-func AggregateScanAndGetQueue(pluginName string, currentContent map[string]string, counts int, ignoreLength bool) []map[string]string {
-	aggregatedScans, err := dbservice.AggregateScans(pluginName, currentContent, counts, ignoreLength)
+// AggregateScanAndGetQueue adds currentContent to pluginName's pending
+// aggregation queue, bounded by pluginSettings' AggregateMaxQueueSize /
+// AggregateDropPolicy, and returns the queue once it's ready to be sent.
+// pluginSettings may be nil for callers (like the Aggregator's periodic
+// flush) that only want to read the queue, not bound it.
+func AggregateScanAndGetQueue(pluginName string, currentContent map[string]string, counts int, ignoreLength bool, pluginSettings *settings.Settings) []map[string]string {
+	log := currentLogger().With("plugin", pluginName)
+	opts := dbservice.QueueOptions{}
+	if pluginSettings != nil {
+		opts.MaxSize = pluginSettings.AggregateMaxQueueSize
+		opts.Policy = dbservice.DropPolicy(pluginSettings.AggregateDropPolicy)
+		opts.SpillDir = pluginSettings.AggregateSpillDir
+	}
+	if len(currentContent) > 0 {
+		recordQueued()
+	}
+
+	aggregatedScans, dropped, err := dbservice.AggregateScansBounded(pluginName, currentContent, counts, ignoreLength, opts)
+	if dropped > 0 {
+		recordDropped(dropped)
+		log.Warn("aggregation queue overflowed", "dropped", dropped, "policy", opts.Policy, "max_size", opts.MaxSize)
+	}
 	if err != nil {
-		log.Printf("AggregateScans Error: %v", err)
+		log.Error("AggregateScans failed", "error", err)
 		return aggregatedScans
 	}
 	if len(currentContent) != 0 && len(aggregatedScans) == 0 {
-		log.Printf("New scan was added to the queue of %q without sending.", pluginName)
+		log.Debug("scan added to aggregation queue without sending")
 		return nil
 	}
 	return aggregatedScans
@@ -0,0 +1,41 @@
+package scanservice
+
+import (
+	"log/slog"
+	"sync/atomic"
+)
+
+var pkgLogger atomic.Value
+
+func init() {
+	pkgLogger.Store(slog.Default())
+}
+
+// Option configures package-level behavior of ScanService via Configure.
+type Option func(*options)
+
+type options struct {
+	logger *slog.Logger
+}
+
+// WithLogger makes ScanService log through l instead of slog.Default(),
+// e.g. to plug in a JSON or OTLP handler.
+func WithLogger(l *slog.Logger) Option {
+	return func(o *options) { o.logger = l }
+}
+
+// Configure applies opts to ScanService's package-level behavior. It is safe
+// to call concurrently with ResultHandling.
+func Configure(opts ...Option) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.logger != nil {
+		pkgLogger.Store(o.logger)
+	}
+}
+
+func currentLogger() *slog.Logger {
+	return pkgLogger.Load().(*slog.Logger)
+}
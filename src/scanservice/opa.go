@@ -0,0 +1,434 @@
+package scanservice
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/storage/inmem"
+)
+
+// policySourceRefresh is how often an HTTP(S) or bundle PolicySource is
+// allowed to re-fetch its origin.
+const policySourceRefresh = 5 * time.Minute
+
+// PolicySource knows how to load a set of rego modules, plus any auxiliary
+// data documents that should be made available to them under data, from
+// a single origin: a local file, an HTTP(S) URL, or an OPA bundle archive.
+type PolicySource interface {
+	// Load returns the current rego modules (keyed by module name) and data
+	// documents for this source, re-fetching the origin if it is due for a
+	// refresh or has changed since the last fetch.
+	Load() (modules map[string]string, data map[string]interface{}, err error)
+}
+
+var (
+	policySourcesMu sync.Mutex
+	policySources   = map[string]PolicySource{}
+)
+
+// policySourceFor returns the cached PolicySource for path, creating one if
+// this is the first time path has been seen.
+func policySourceFor(path string) PolicySource {
+	policySourcesMu.Lock()
+	defer policySourcesMu.Unlock()
+	if src, ok := policySources[path]; ok {
+		return src
+	}
+	src := newPolicySource(path)
+	policySources[path] = src
+	return src
+}
+
+func newPolicySource(path string) PolicySource {
+	switch {
+	case strings.HasPrefix(path, "http://"), strings.HasPrefix(path, "https://"):
+		if strings.HasSuffix(path, ".tar.gz") {
+			return &bundleSource{url: path}
+		}
+		return &httpSource{url: path}
+	case strings.HasSuffix(path, ".tar.gz"):
+		return &bundleSource{path: path}
+	default:
+		return &fileSource{path: path}
+	}
+}
+
+// fileSource loads a single .rego or .json file, or a directory containing
+// .rego modules and an optional data.json, from disk.
+type fileSource struct {
+	path string
+}
+
+func (f *fileSource) Load() (map[string]string, map[string]interface{}, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("stat %q: %w", f.path, err)
+	}
+
+	modules := map[string]string{}
+	var dataDoc map[string]interface{}
+
+	if !info.IsDir() {
+		content, err := os.ReadFile(f.path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("read %q: %w", f.path, err)
+		}
+		if strings.HasSuffix(f.path, ".json") {
+			var dataDoc map[string]interface{}
+			if err := json.Unmarshal(content, &dataDoc); err != nil {
+				return nil, nil, fmt.Errorf("parse %q: %w", f.path, err)
+			}
+			return nil, dataDoc, nil
+		}
+		modules[f.path] = string(content)
+		return modules, nil, nil
+	}
+
+	err = filepath.Walk(f.path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		switch {
+		case strings.HasSuffix(p, ".rego"):
+			content, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			modules[p] = string(content)
+		case strings.HasSuffix(p, "data.json"):
+			content, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			return json.Unmarshal(content, &dataDoc)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return modules, dataDoc, nil
+}
+
+// httpSource loads a single .rego module, or a .json data document, from an
+// HTTP(S) URL, using ETag/If-Modified-Since caching so it only re-fetches
+// when the origin has actually changed.
+type httpSource struct {
+	url string
+
+	mu          sync.Mutex
+	fetchedAt   time.Time
+	etag        string
+	lastModTime string
+	cachedBody  string
+}
+
+func (h *httpSource) Load() (map[string]string, map[string]interface{}, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.fetchedAt.IsZero() && time.Since(h.fetchedAt) < policySourceRefresh {
+		return h.cachedResult()
+	}
+
+	req, err := http.NewRequest(http.MethodGet, h.url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if h.etag != "" {
+		req.Header.Set("If-None-Match", h.etag)
+	}
+	if h.lastModTime != "" {
+		req.Header.Set("If-Modified-Since", h.lastModTime)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fetch %q: %w", h.url, err)
+	}
+	defer resp.Body.Close()
+
+	h.fetchedAt = time.Now()
+	if resp.StatusCode == http.StatusNotModified {
+		return h.cachedResult()
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("fetch %q: unexpected status %d", h.url, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	h.cachedBody = string(body)
+	h.etag = resp.Header.Get("ETag")
+	h.lastModTime = resp.Header.Get("Last-Modified")
+	return h.cachedResult()
+}
+
+// cachedResult returns h.cachedBody as a data document if the URL is a
+// .json source, or as a single rego module otherwise, the same way
+// fileSource and readBundle tell modules and data documents apart.
+func (h *httpSource) cachedResult() (map[string]string, map[string]interface{}, error) {
+	if strings.HasSuffix(h.url, ".json") {
+		var dataDoc map[string]interface{}
+		if err := json.Unmarshal([]byte(h.cachedBody), &dataDoc); err != nil {
+			return nil, nil, fmt.Errorf("parse %q: %w", h.url, err)
+		}
+		return nil, dataDoc, nil
+	}
+	return map[string]string{h.url: h.cachedBody}, nil, nil
+}
+
+// bundleSource loads an OPA bundle (a tar.gz archive containing .rego
+// modules and an optional data.json) from either a local path or an
+// HTTP(S) URL.
+type bundleSource struct {
+	path string
+	url  string
+
+	mu        sync.Mutex
+	fetchedAt time.Time
+	etag      string
+	modules   map[string]string
+	dataDoc   map[string]interface{}
+}
+
+func (b *bundleSource) Load() (map[string]string, map[string]interface{}, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.fetchedAt.IsZero() && time.Since(b.fetchedAt) < policySourceRefresh {
+		return b.modules, b.dataDoc, nil
+	}
+
+	var r io.Reader
+	if b.url != "" {
+		req, err := http.NewRequest(http.MethodGet, b.url, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		if b.etag != "" {
+			req.Header.Set("If-None-Match", b.etag)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, nil, fmt.Errorf("fetch bundle %q: %w", b.url, err)
+		}
+		defer resp.Body.Close()
+		b.fetchedAt = time.Now()
+		if resp.StatusCode == http.StatusNotModified {
+			return b.modules, b.dataDoc, nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, nil, fmt.Errorf("fetch bundle %q: unexpected status %d", b.url, resp.StatusCode)
+		}
+		b.etag = resp.Header.Get("ETag")
+		r = resp.Body
+	} else {
+		f, err := os.Open(b.path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("open bundle %q: %w", b.path, err)
+		}
+		defer f.Close()
+		b.fetchedAt = time.Now()
+		r = f
+	}
+
+	modules, dataDoc, err := readBundle(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	b.modules, b.dataDoc = modules, dataDoc
+	return modules, dataDoc, nil
+}
+
+func readBundle(r io.Reader) (map[string]string, map[string]interface{}, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("gunzip bundle: %w", err)
+	}
+	defer gz.Close()
+
+	modules := map[string]string{}
+	var dataDoc map[string]interface{}
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("read bundle entry: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("read bundle entry %q: %w", hdr.Name, err)
+		}
+		switch {
+		case strings.HasSuffix(hdr.Name, ".rego"):
+			modules[hdr.Name] = string(content)
+		case strings.HasSuffix(hdr.Name, "data.json"):
+			if err := json.Unmarshal(content, &dataDoc); err != nil {
+				return nil, nil, fmt.Errorf("parse %q: %w", hdr.Name, err)
+			}
+		}
+	}
+	return modules, dataDoc, nil
+}
+
+// preparedPolicy is a compiled rego query cached by the hash of the modules
+// and data it was built from, so a settings reload that leaves the policy
+// unchanged doesn't pay to recompile it.
+type preparedPolicy struct {
+	query rego.PreparedEvalQuery
+}
+
+var (
+	preparedPoliciesMu sync.Mutex
+	preparedPolicies   = map[string]*preparedPolicy{}
+	// preparedHashByPath remembers the most recent hash prepared for each
+	// policy path, so preparedPolicyFor can evict the stale entry once a
+	// refresh changes that path's modules or data instead of growing
+	// preparedPolicies forever.
+	preparedHashByPath = map[string]string{}
+)
+
+func hashModules(modules map[string]string, data map[string]interface{}) (string, error) {
+	h := sha256.New()
+	keys := make([]string, 0, len(modules))
+	for k := range modules {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		io.WriteString(h, k)
+		io.WriteString(h, modules[k])
+	}
+	if data != nil {
+		enc, err := json.Marshal(data)
+		if err != nil {
+			return "", err
+		}
+		h.Write(enc)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func preparedPolicyFor(path string, modules map[string]string, data map[string]interface{}) (*preparedPolicy, error) {
+	hash, err := hashModules(modules, data)
+	if err != nil {
+		return nil, err
+	}
+
+	preparedPoliciesMu.Lock()
+	if p, ok := preparedPolicies[hash]; ok {
+		preparedHashByPath[path] = hash
+		preparedPoliciesMu.Unlock()
+		return p, nil
+	}
+	preparedPoliciesMu.Unlock()
+
+	opts := []func(*rego.Rego){rego.Query("data.aqua.allow")}
+	for name, content := range modules {
+		opts = append(opts, rego.Module(name, content))
+	}
+	if data != nil {
+		opts = append(opts, rego.Store(inmem.NewFromObject(data)))
+	}
+
+	query, err := rego.New(opts...).PrepareForEval(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("prepare rego query: %w", err)
+	}
+
+	p := &preparedPolicy{query: query}
+	preparedPoliciesMu.Lock()
+	if prevHash, ok := preparedHashByPath[path]; ok && prevHash != hash {
+		delete(preparedPolicies, prevHash)
+	}
+	preparedPolicies[hash] = p
+	preparedHashByPath[path] = hash
+	preparedPoliciesMu.Unlock()
+	return p, nil
+}
+
+// isRegoCorrect evaluates input against every OPA policy listed in policies
+// (each a file path, HTTP(S) URL, or bundle archive, as resolved by
+// PolicySource) and returns true if any of them allow the scan. dataSources,
+// if non-empty, are loaded the same way and their data documents are merged
+// in under data alongside whatever each policy bundle carries.
+func isRegoCorrect(policies, dataSources []string, input string) (bool, error) {
+	var scanInput map[string]interface{}
+	if err := json.Unmarshal([]byte(input), &scanInput); err != nil {
+		return false, fmt.Errorf("isRegoCorrect: parse input: %w", err)
+	}
+
+	auxData := map[string]interface{}{}
+	for _, path := range dataSources {
+		_, data, err := policySourceFor(path).Load()
+		if err != nil {
+			return false, fmt.Errorf("isRegoCorrect: load data %q: %w", path, err)
+		}
+		for k, v := range data {
+			auxData[k] = v
+		}
+	}
+
+	for _, path := range policies {
+		modules, data, err := policySourceFor(path).Load()
+		if err != nil {
+			return false, fmt.Errorf("isRegoCorrect: load %q: %w", path, err)
+		}
+		if len(auxData) > 0 {
+			// data may be the PolicySource's own cached map (e.g. a
+			// bundleSource's dataDoc), shared across callers and refreshes.
+			// Merge into a fresh map instead of mutating it in place, so
+			// one plugin's PolicyOPAData can't leak into another's
+			// evaluation of the same bundle, and concurrent scans don't
+			// race writing into the cached map.
+			merged := make(map[string]interface{}, len(data)+len(auxData))
+			for k, v := range data {
+				merged[k] = v
+			}
+			for k, v := range auxData {
+				merged[k] = v
+			}
+			data = merged
+		}
+
+		policy, err := preparedPolicyFor(path, modules, data)
+		if err != nil {
+			return false, fmt.Errorf("isRegoCorrect: %q: %w", path, err)
+		}
+
+		results, err := policy.query.Eval(context.Background(), rego.EvalInput(scanInput))
+		if err != nil {
+			return false, fmt.Errorf("isRegoCorrect: eval %q: %w", path, err)
+		}
+		if len(results) > 0 && len(results[0].Expressions) > 0 {
+			if allow, ok := results[0].Expressions[0].Value.(bool); ok && allow {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
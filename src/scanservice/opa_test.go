@@ -0,0 +1,76 @@
+package scanservice
+
+import "testing"
+
+func TestHashModulesOrderIndependent(t *testing.T) {
+	a, err := hashModules(map[string]string{"a.rego": "x", "b.rego": "y"}, nil)
+	if err != nil {
+		t.Fatalf("hashModules: %v", err)
+	}
+	b, err := hashModules(map[string]string{"b.rego": "y", "a.rego": "x"}, nil)
+	if err != nil {
+		t.Fatalf("hashModules: %v", err)
+	}
+	if a != b {
+		t.Errorf("hashModules should be independent of map iteration order, got %q != %q", a, b)
+	}
+}
+
+func TestHashModulesDataChangesHash(t *testing.T) {
+	modules := map[string]string{"a.rego": "x"}
+	h1, err := hashModules(modules, map[string]interface{}{"allow": []string{"a"}})
+	if err != nil {
+		t.Fatalf("hashModules: %v", err)
+	}
+	h2, err := hashModules(modules, map[string]interface{}{"allow": []string{"b"}})
+	if err != nil {
+		t.Fatalf("hashModules: %v", err)
+	}
+	if h1 == h2 {
+		t.Error("hashModules should produce different hashes when data differs")
+	}
+}
+
+const allowRegoModule = `package aqua
+
+allow = true
+`
+
+func TestPreparedPolicyForCachesIdenticalInput(t *testing.T) {
+	modules := map[string]string{"allow.rego": allowRegoModule}
+	p1, err := preparedPolicyFor("test-cache-path", modules, nil)
+	if err != nil {
+		t.Fatalf("preparedPolicyFor: %v", err)
+	}
+	p2, err := preparedPolicyFor("test-cache-path", modules, nil)
+	if err != nil {
+		t.Fatalf("preparedPolicyFor: %v", err)
+	}
+	if p1 != p2 {
+		t.Error("preparedPolicyFor should return the cached entry for identical modules/data")
+	}
+}
+
+func TestPreparedPolicyForEvictsStaleHashOnChange(t *testing.T) {
+	path := "test-evict-path"
+	modules1 := map[string]string{"allow.rego": allowRegoModule}
+	if _, err := preparedPolicyFor(path, modules1, nil); err != nil {
+		t.Fatalf("preparedPolicyFor: %v", err)
+	}
+	hash1, err := hashModules(modules1, nil)
+	if err != nil {
+		t.Fatalf("hashModules: %v", err)
+	}
+
+	modules2 := map[string]string{"allow.rego": allowRegoModule + "\n# changed\n"}
+	if _, err := preparedPolicyFor(path, modules2, nil); err != nil {
+		t.Fatalf("preparedPolicyFor: %v", err)
+	}
+
+	preparedPoliciesMu.Lock()
+	_, stillCached := preparedPolicies[hash1]
+	preparedPoliciesMu.Unlock()
+	if stillCached {
+		t.Error("preparedPolicyFor should evict path's previous hash once its modules/data change")
+	}
+}
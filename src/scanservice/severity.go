@@ -0,0 +1,53 @@
+package scanservice
+
+import (
+	"strings"
+	"time"
+
+	"settings"
+)
+
+// checkCVSSPolicy implements the fine-grained severity gate: PolicyMinCVSS,
+// PolicyIgnoreCVEs, PolicyRequireCVEs and PolicyMaxAgeDays. It complements
+// the coarser checkVulnerabilitiesLevel bucket check. A scan passes only if
+// at least one vulnerability survives the ignore-list, is within
+// PolicyMaxAgeDays (when set), meets PolicyMinCVSS (when set), and - when
+// PolicyRequireCVEs is non-empty - is one of the listed CVEs.
+func (scan *ScanService) checkCVSSPolicy(s *settings.Settings) bool {
+	if s.PolicyMinCVSS <= 0 && s.PolicyMaxAgeDays <= 0 && len(s.PolicyIgnoreCVEs) == 0 && len(s.PolicyRequireCVEs) == 0 {
+		return true
+	}
+
+	ignore := toCVESet(s.PolicyIgnoreCVEs)
+	require := toCVESet(s.PolicyRequireCVEs)
+	maxAge := time.Duration(s.PolicyMaxAgeDays) * 24 * time.Hour
+	now := time.Now()
+
+	for _, r := range scan.scanInfo.Resources {
+		for _, v := range r.Vulnerabilities {
+			cve := strings.ToUpper(v.Name)
+			if ignore[cve] {
+				continue
+			}
+			if len(require) > 0 && !require[cve] {
+				continue
+			}
+			if s.PolicyMaxAgeDays > 0 && !v.PublishedDate.IsZero() && now.Sub(v.PublishedDate) > maxAge {
+				continue
+			}
+			if s.PolicyMinCVSS > 0 && v.CVSS < s.PolicyMinCVSS {
+				continue
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func toCVESet(cves []string) map[string]bool {
+	set := make(map[string]bool, len(cves))
+	for _, cve := range cves {
+		set[strings.ToUpper(cve)] = true
+	}
+	return set
+}
@@ -0,0 +1,39 @@
+package settings
+
+// Settings holds the per-plugin policy and delivery configuration loaded
+// from plugin YAML.
+type Settings struct {
+	PluginName string
+	AquaServer string
+
+	PolicyShowAll                   bool
+	PolicyMinVulnerability          string
+	IgnoreRegistry                  []string
+	IgnoreImageName                 []string
+	PolicyImageName                 []string
+	PolicyRegistry                  []string
+	PolicyNonCompliant              bool
+	PolicyOnlyFixAvailable          bool
+	PolicyOPA                       []string
+	PolicyOPAData                   []string
+	PolicyMinCVSS                   float64
+	PolicyIgnoreCVEs                []string
+	PolicyRequireCVEs               []string
+	PolicyMaxAgeDays                int
+	PolicySuppressDuplicatesSeconds int
+
+	AggregateIssuesNumber   int
+	AggregateTimeoutSeconds int
+	AggregateMaxQueueSize   int
+	AggregateDropPolicy     string
+	AggregateSpillDir       string
+	IsScheduleRun           bool
+}
+
+// GetDefaultSettings returns the Settings used for a plugin that didn't
+// supply its own configuration.
+func GetDefaultSettings() *Settings {
+	return &Settings{
+		PolicyShowAll: true,
+	}
+}